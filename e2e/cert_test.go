@@ -0,0 +1,112 @@
+//go:build e2e_testing
+// +build e2e_testing
+
+package e2e
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"golang.org/x/crypto/ed25519"
+)
+
+// NewTestCert generates a v1 nebula certificate signed by caCrt/caKey, matching
+// the curve the CA itself uses (Ed25519). It returns the certificate, its
+// public key, its private key and the PEM-encoded certificate, in that order.
+func NewTestCert(caCrt *cert.NebulaCertificate, caKey []byte, name string, before, after time.Time, ipNet *net.IPNet, subnets []*net.IPNet, groups []string) (*cert.NebulaCertificate, []byte, []byte, []byte) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	nc := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      name,
+			Ips:       []*net.IPNet{ipNet},
+			Subnets:   subnets,
+			Groups:    groups,
+			NotBefore: before,
+			NotAfter:  after,
+			PublicKey: pub,
+			IsCA:      false,
+			Issuer:    caCrt.Details.Name,
+		},
+	}
+
+	if err := nc.Sign(cert.Curve_CURVE25519, caKey); err != nil {
+		panic(err)
+	}
+
+	pem, err := nc.MarshalToPEM()
+	if err != nil {
+		panic(err)
+	}
+
+	return nc, pub, priv, pem
+}
+
+// NewTestCertV2 is the v2 analog of NewTestCert: it issues an ASN.1-framed v2
+// certificate over a P-256 keypair, to exercise the cross-curve signing path
+// that v2 CAs support alongside Ed25519.
+func NewTestCertV2(caCrt *cert.NebulaCertificate, caKey []byte, name string, before, after time.Time, ipNet *net.IPNet, subnets []*net.IPNet, groups []string) (*cert.NebulaCertificate, []byte, []byte, []byte) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	pub := elliptic.Marshal(elliptic.P256(), priv.X, priv.Y)
+	privBytes, err := ecdsaMarshalPrivateKey(priv)
+	if err != nil {
+		panic(err)
+	}
+
+	nc := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      name,
+			Ips:       []*net.IPNet{ipNet},
+			Subnets:   subnets,
+			Groups:    groups,
+			NotBefore: before,
+			NotAfter:  after,
+			PublicKey: pub,
+			IsCA:      false,
+			Issuer:    caCrt.Details.Name,
+			Curve:     cert.Curve_P256,
+		},
+	}
+
+	// The signing curve matches the CA key's own curve, not the leaf's: a
+	// v1 (Ed25519) CA can issue a v2 leaf just fine, but SignV2 needs to be
+	// told it's signing with an Ed25519 key in that case, not P-256. A v1
+	// CA has no Details.Curve set (v1 has no such field), so the zero value
+	// means Ed25519 here.
+	caCurve := cert.Curve_CURVE25519
+	if caCrt.Details.Curve == cert.Curve_P256 {
+		caCurve = cert.Curve_P256
+	}
+
+	if err := nc.SignV2(caCurve, caKey); err != nil {
+		panic(err)
+	}
+
+	pemBytes, err := nc.MarshalToPEM()
+	if err != nil {
+		panic(err)
+	}
+
+	return nc, pub, privBytes, pemBytes
+}
+
+// ecdsaMarshalPrivateKey returns priv.D as a fixed-width, left-zero-padded
+// big-endian byte slice the width of the curve's field. priv.D.Bytes() alone
+// strips leading zero bytes, which would silently truncate roughly 1 in 256
+// P-256 keys below the expected 32 bytes.
+func ecdsaMarshalPrivateKey(priv *ecdsa.PrivateKey) ([]byte, error) {
+	size := (priv.Curve.Params().BitSize + 7) / 8
+	b := make([]byte, size)
+	priv.D.FillBytes(b)
+	return b, nil
+}
@@ -0,0 +1,93 @@
+//go:build e2e_testing
+// +build e2e_testing
+
+package e2e
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/e2e/router"
+)
+
+// newTestCaCert issues a self-signed CA certificate at the given version,
+// for use as the root of trust in a single e2e scenario.
+func newTestCaCert(version cert.Version) (*cert.NebulaCertificate, []byte) {
+	var pub, priv []byte
+	var err error
+
+	switch version {
+	case cert.Version2:
+		pub, priv, err = cert.GenerateECDSAKeys(cert.Curve_P256)
+	default:
+		pub, priv, err = cert.GenerateEd25519Keys()
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	nc := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      "ca",
+			NotBefore: time.Now(),
+			NotAfter:  time.Now().Add(time.Hour),
+			IsCA:      true,
+			PublicKey: pub,
+		},
+	}
+
+	switch version {
+	case cert.Version2:
+		nc.Details.Curve = cert.Curve_P256
+		if err := nc.SignV2(cert.Curve_P256, priv); err != nil {
+			panic(err)
+		}
+	default:
+		if err := nc.Sign(cert.Curve_CURVE25519, priv); err != nil {
+			panic(err)
+		}
+	}
+
+	return nc, priv
+}
+
+// TestGoodHandshake_CertVersionMatrix locks down v1/v2 interop: every e2e
+// scenario should converge identically whether both ends present v1
+// certs, both present v2 certs, or a v1 CA issues a v2 leaf.
+func TestGoodHandshake_CertVersionMatrix(t *testing.T) {
+	cases := []struct {
+		name      string
+		caVersion cert.Version
+		aVersion  cert.Version
+		bVersion  cert.Version
+	}{
+		{"v1", cert.Version1, cert.Version1, cert.Version1},
+		{"v2", cert.Version2, cert.Version2, cert.Version2},
+		{"mixed-v1-ca-v2-leaf", cert.Version1, cert.Version2, cert.Version2},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			caCrt, caKey := newTestCaCert(tt.caVersion)
+
+			myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServerVersion(tt.aVersion, caCrt, caKey, "me", net.IP{10, 0, 0, 1}, nil, nil)
+			theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServerVersion(tt.bVersion, caCrt, caKey, "them", net.IP{10, 0, 0, 2}, nil, nil)
+
+			r := router.NewR(t, myControl, theirControl)
+			myControl.Start()
+			theirControl.Start()
+
+			// Send a packet from me to them: this starts the handshake, and
+			// the packet reaches their tun once the handshake completes.
+			myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+			r.RouteForAllUntilTxTun(theirControl)
+			assertHostInfoPair(t, myUdpAddr, theirUdpAddr, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl)
+			assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+
+			myControl.Stop()
+			theirControl.Stop()
+		})
+	}
+}
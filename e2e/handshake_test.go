@@ -0,0 +1,35 @@
+//go:build e2e_testing
+// +build e2e_testing
+
+package e2e
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/e2e/router"
+)
+
+// TestHandshake_RetriesUntilComplete is the test assertHandshakeRetries was
+// added for: drive the handshake purely off the virtual clock and confirm
+// both sides learn about each other within a bounded number of retry steps,
+// with no real-time sleeping involved.
+func TestHandshake_RetriesUntilComplete(t *testing.T) {
+	ca, caKey := newTestCaCert(cert.Version1)
+
+	controlA, vpnIpNetA, _, _ := newSimpleServer(ca, caKey, "a", net.IP{10, 0, 0, 1}, nil, nil)
+	controlB, vpnIpNetB, _, _ := newSimpleServer(ca, caKey, "b", net.IP{10, 0, 0, 2}, nil, nil)
+
+	r := router.NewR(t, controlA, controlB)
+	controlA.Start()
+	controlB.Start()
+
+	controlA.InjectTunUDPPacket(vpnIpNetB.IP, 80, 90, []byte("hi"))
+
+	assertHandshakeRetries(t, vpnIpNetA.IP, vpnIpNetB.IP, controlA, controlB, r, 250*time.Millisecond, 40)
+
+	controlA.Stop()
+	controlB.Stop()
+}
@@ -0,0 +1,41 @@
+//go:build e2e_testing
+// +build e2e_testing
+
+package e2e
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/e2e/router"
+)
+
+// TestTunnel_ConvergesUnderImpairment is the test assertTunnelUnderImpairment
+// was added for: a lossy, delayed, jittery edge should still let the tunnel
+// come up and carry data, just slower, as handshake and data retries absorb
+// the impairment.
+func TestTunnel_ConvergesUnderImpairment(t *testing.T) {
+	ca, caKey := newTestCaCert(cert.Version1)
+
+	controlA, vpnIpNetA, _, _ := newSimpleServer(ca, caKey, "a", net.IP{10, 0, 0, 1}, nil, nil)
+	controlB, vpnIpNetB, _, _ := newSimpleServer(ca, caKey, "b", net.IP{10, 0, 0, 2}, nil, nil)
+
+	r := router.NewR(t, controlA, controlB)
+	controlA.Start()
+	controlB.Start()
+
+	r.Impair(controlA, controlB, router.Profile{
+		Loss:    0.3,
+		Delay:   20 * time.Millisecond,
+		Jitter:  10 * time.Millisecond,
+		Reorder: 0.2,
+		Seed:    1,
+	})
+
+	assertTunnelUnderImpairment(t, vpnIpNetA.IP, vpnIpNetB.IP, controlA, controlB, r, 200)
+
+	controlA.Stop()
+	controlB.Stop()
+}
@@ -0,0 +1,85 @@
+//go:build e2e_testing
+// +build e2e_testing
+
+package e2e
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/e2e/router"
+)
+
+// dnsTTLAdvance is comfortably longer than any re-resolve interval nebula
+// schedules for a static_host_map hostname entry, so advancing by this much
+// guarantees the refresh timer fires. The lookup itself then runs on the
+// refresh goroutine, after Advance returns.
+const dnsTTLAdvance = 30 * time.Second
+
+// fakeResolver maps hostnames to scripted answers, so e2e tests can simulate
+// DNS TTL expiry without touching real DNS. Each hostname has one current
+// answer, replaced by Set and returned unchanged by every lookup.
+type fakeResolver struct {
+	mu      sync.Mutex
+	answers map[string][]netip.Addr
+}
+
+func newFakeResolver() *fakeResolver {
+	return &fakeResolver{answers: make(map[string][]netip.Addr)}
+}
+
+// Set overwrites the current answer for host, simulating a DNS record
+// change that will be picked up the next time it's looked up.
+func (f *fakeResolver) Set(host string, addrs ...netip.Addr) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.answers[host] = addrs
+}
+
+func (f *fakeResolver) LookupNetIP(_ context.Context, _, host string) ([]netip.Addr, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.answers[host], nil
+}
+
+// TestStaticHostMap_ResolverRebind locks down the remote_list.unlockedCollect
+// fix around static_host_map entries that mix v4 and v6 answers: when the
+// resolver's answer for a hostname changes mid-run, the tunnel should rebind
+// to the new remote.
+func TestStaticHostMap_ResolverRebind(t *testing.T) {
+	ca, caKey := newTestCaCert(cert.Version1)
+
+	resolver := newFakeResolver()
+	resolver.Set("them.test", netip.MustParseAddr("10.0.0.2"))
+
+	// theirControl is built first so we know its vpn ip, which is what
+	// myControl's static_host_map entry needs to key off of.
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServerVersion(cert.Version1, ca, caKey, "them", net.IP{10, 0, 0, 2}, nil, nil)
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServerWithHostname(ca, caKey, "me", net.IP{10, 0, 0, 1}, theirVpnIpNet.IP, "them.test", resolver, nil)
+
+	r := router.NewR(t, myControl, theirControl)
+	myControl.Start()
+	theirControl.Start()
+
+	// Send a packet from me to them: this starts the handshake, and the
+	// packet reaches their tun once the handshake completes.
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	r.RouteForAllUntilTxTun(theirControl)
+	assertHostInfoPair(t, myUdpAddr, theirUdpAddr, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl)
+
+	// Flip the resolver's answer to a v6 address mid-run and make sure the
+	// tunnel still converges against the new remote rather than wedging on
+	// the stale v4 entry.
+	resolver.Set("them.test", netip.MustParseAddr("fd00::2"))
+	r.Advance(dnsTTLAdvance)
+
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+
+	myControl.Stop()
+	theirControl.Stop()
+}
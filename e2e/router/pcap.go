@@ -0,0 +1,109 @@
+//go:build e2e_testing
+// +build e2e_testing
+
+package router
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/slackhq/nebula"
+)
+
+// outsideLinkType tags the outside UDP bus interface in the pcap-ng file
+// with LINKTYPE_USER0 rather than a raw-IP type: outside traffic is
+// nebula's own handshake/data wire framing, not an IP packet, and a reader
+// that tries to decode it as one (LinkTypeRaw, which tun traffic correctly
+// uses) will fail to parse it.
+const outsideLinkType = layers.LinkType(147)
+
+// capture holds the pcap-ng writer and backing file for a single control,
+// with separate interfaces for its tun traffic (raw IP) and its outside UDP
+// bus (nebula's own wire framing).
+type capture struct {
+	f            *os.File
+	w            *pcapgo.NgWriter
+	tunIface     int
+	outsideIface int
+}
+
+// pcapCaptures is keyed by control name and is only populated when
+// TEST_PCAP is set.
+type pcapCaptures map[string]*capture
+
+// newPCAPCaptures mirrors the TEST_LOGS convention: when TEST_PCAP=<dir> is
+// set, one pcap-ng file per control is created in that directory, named
+// after the control. If TEST_PCAP is unset, capture is a no-op.
+func newPCAPCaptures(dir string, controls []*nebula.Control) pcapCaptures {
+	if dir == "" {
+		return nil
+	}
+
+	caps := make(pcapCaptures, len(controls))
+	for _, c := range controls {
+		name := c.GetUDPAddr().String()
+
+		f, err := os.Create(filepath.Join(dir, fmt.Sprintf("%s.pcapng", name)))
+		if err != nil {
+			panic(err)
+		}
+
+		w, err := pcapgo.NewNgWriter(f, layers.LinkTypeRaw)
+		if err != nil {
+			panic(err)
+		}
+
+		tunIface := 0
+		outsideIface, err := w.AddInterface(pcapgo.NgInterface{
+			Name:     "outside",
+			LinkType: outsideLinkType,
+		})
+		if err != nil {
+			panic(err)
+		}
+
+		caps[name] = &capture{f: f, w: w, tunIface: tunIface, outsideIface: outsideIface}
+	}
+
+	return caps
+}
+
+// write records a single packet observed between from and to at now — which
+// callers must source from the router's own virtual clock (r.now), not
+// time.Now(), so tun and outside captures share one consistent, monotonic
+// timeline regardless of whether the edge is impaired. dir selects which
+// interface the packet is attributed to ("outside" or "tun").
+func (caps pcapCaptures) write(from, to string, now time.Time, dir string, data []byte) {
+	if caps == nil {
+		return
+	}
+
+	iface := func(c *capture) int {
+		if dir == "tun" {
+			return c.tunIface
+		}
+		return c.outsideIface
+	}
+
+	if c := caps[from]; c != nil {
+		ci := gopacket.CaptureInfo{Timestamp: now, CaptureLength: len(data), Length: len(data), InterfaceIndex: iface(c)}
+		_ = c.w.WritePacket(ci, data)
+	}
+	if c := caps[to]; c != nil && to != from {
+		ci := gopacket.CaptureInfo{Timestamp: now, CaptureLength: len(data), Length: len(data), InterfaceIndex: iface(c)}
+		_ = c.w.WritePacket(ci, data)
+	}
+}
+
+// Close flushes and closes every capture file.
+func (caps pcapCaptures) Close() {
+	for _, c := range caps {
+		_ = c.w.Flush()
+		_ = c.f.Close()
+	}
+}
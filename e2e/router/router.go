@@ -0,0 +1,277 @@
+//go:build e2e_testing
+// +build e2e_testing
+
+// Package router provides an in-memory packet router used by the e2e test
+// suite to ferry packets between a set of nebula.Control instances without
+// touching a real network or kernel tun device.
+package router
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// R routes packets between a set of controls. By default it is fully
+// deterministic: a packet written to a control's outside UDP conn is
+// delivered to its destination the next time the test asks for it, in
+// program order. Call Impair to attach a lossy/delayed/reordered profile to
+// a pair of controls.
+type R struct {
+	t testing.TB
+
+	// controls maps a control's vpn ip to the control itself
+	controls map[iputil.VpnIp]*nebula.Control
+
+	// addrToControl maps a control's outside udp addr to the control itself
+	addrToControl map[string]*nebula.Control
+
+	// impairments is keyed by the unordered pair of control names that an
+	// edge connects; see edgeKey.
+	impairments map[string]*impairment
+
+	// pcap is nil unless TEST_PCAP is set, mirroring the TEST_LOGS
+	// convention used by NewTestLogger.
+	pcap pcapCaptures
+
+	// now is the router's own virtual clock, advanced by exactly the same d
+	// as nebula.AdvanceClock on every Advance call. pcap timestamps are
+	// always sourced from here — never time.Now() — so tun and outside
+	// captures land on one consistent, monotonic timeline whether or not
+	// the edge between them is impaired. It starts at the same Unix epoch
+	// pin as nebula's fake clock rather than Go's zero time.
+	now time.Time
+}
+
+// NewR builds a router for the given set of controls. Controls are expected
+// to already be started (nebula.Main called) by the caller.
+func NewR(t testing.TB, controls ...*nebula.Control) *R {
+	r := &R{
+		t:             t,
+		controls:      make(map[iputil.VpnIp]*nebula.Control, len(controls)),
+		addrToControl: make(map[string]*nebula.Control, len(controls)),
+		impairments:   make(map[string]*impairment),
+		pcap:          newPCAPCaptures(os.Getenv("TEST_PCAP"), controls),
+		now:           time.Unix(0, 0),
+	}
+
+	for _, c := range controls {
+		r.controls[c.GetVpnIp()] = c
+		r.addrToControl[c.GetUDPAddr().String()] = c
+	}
+
+	// The router already knows every control's vpn ip and outside address,
+	// so it seeds each pair directly rather than simulating a lighthouse.
+	// Seeding only hands out an address to dial; the handshake, firewall and
+	// allow_list still run for real on top of it.
+	for _, a := range controls {
+		for _, b := range controls {
+			if a == b {
+				continue
+			}
+			a.Seed(iputil.VpnIp2Ip(b.GetVpnIp()), b.GetUDPAddr())
+		}
+	}
+
+	if r.pcap != nil {
+		t.Cleanup(r.pcap.Close)
+	}
+
+	return r
+}
+
+// RouteForAllUntilTxTun routes packets between all known controls until
+// receiver emits a packet on its tun device, which is returned.
+func (r *R) RouteForAllUntilTxTun(receiver *nebula.Control) []byte {
+	for {
+		if b := r.routeOneStep(); b != nil {
+			return b
+		}
+
+		if p := receiver.GetFromTun(false); p != nil {
+			r.pcap.write(receiver.GetUDPAddr().String(), receiver.GetUDPAddr().String(), r.now, "tun", p)
+			return p
+		}
+	}
+}
+
+// Drain runs the router forward a bounded number of steps without advancing
+// the virtual clock. Unlike RouteForAllUntilTxTun, it never blocks, so
+// callers asserting the *absence* of a tun delivery (e.g. a firewall drop)
+// can flush whatever traffic an unimpaired edge would deliver without
+// risking an infinite wait on a packet that's never coming.
+func (r *R) Drain(steps int) {
+	for i := 0; i < steps; i++ {
+		r.routeOneStep()
+	}
+}
+
+// routeOneStep takes at most one packet from each control's outside UDP send
+// queue, handing it to the addressed peer — either straight through, or into that
+// edge's impairment queue if one is attached — then flushes anything an
+// impaired edge has ready to deliver. It never blocks: a step with nothing
+// to do just returns nil.
+func (r *R) routeOneStep() []byte {
+	for _, from := range r.controls {
+		p := from.GetFromUDP(false)
+		if p == nil {
+			continue
+		}
+
+		to, ok := r.addrToControl[(&net.UDPAddr{IP: p.ToIp, Port: int(p.ToPort)}).String()]
+		if !ok {
+			r.t.Logf("router: no control registered for outbound packet to %v:%v", p.ToIp, p.ToPort)
+			continue
+		}
+
+		if imp, ok := r.impairments[edgeKey(from, to)]; ok {
+			imp.enqueue(r.now, from, to, p.Data)
+			continue
+		}
+
+		r.pcap.write(from.GetUDPAddr().String(), to.GetUDPAddr().String(), r.now, "outside", p.Data)
+		to.InjectUDPPacket(from.GetUDPAddr(), p.Data)
+	}
+
+	// Drain any ready packets from impaired edges so that delayed or
+	// reordered traffic interleaves correctly with the live path.
+	for _, imp := range r.impairments {
+		imp.drainReady(r)
+	}
+
+	return nil
+}
+
+// Impair attaches a network impairment profile to the edge between a and b.
+// The profile is applied symmetrically: packets traveling either direction
+// across this edge are subject to the same loss/delay/jitter/reorder rules,
+// each drawn independently from the profile's seeded RNG.
+func (r *R) Impair(a, b *nebula.Control, p Profile) {
+	key := edgeKey(a, b)
+	r.impairments[key] = newImpairment(p)
+}
+
+// Advance moves the router's virtual clock forward by d, firing any
+// handshake retry, pending_deletion or connection_alive timers due in
+// nebula itself, flushing any impaired packets whose delay has elapsed, and
+// routing whatever that unblocks. Without the routeOneStep call, advancing
+// the clock would fire retries and expire delays but never actually move
+// the packets they produce — callers driving a test purely off Advance (as
+// assertHandshakeRetries and assertTunnelUnderImpairment do) would starve.
+func (r *R) Advance(d time.Duration) {
+	nebula.AdvanceClock(d)
+	r.now = r.now.Add(d)
+
+	r.routeOneStep()
+}
+
+func edgeKey(a, b *nebula.Control) string {
+	an, bn := a.GetUDPAddr().String(), b.GetUDPAddr().String()
+	if an > bn {
+		an, bn = bn, an
+	}
+	return fmt.Sprintf("%s|%s", an, bn)
+}
+
+// Profile describes the network impairment to apply to an edge.
+type Profile struct {
+	// Loss is the probability, in [0, 1], that a packet is dropped entirely.
+	Loss float64
+
+	// Delay is the fixed one-way delay applied to every packet on this edge.
+	Delay time.Duration
+
+	// Jitter is added to Delay uniformly in [-Jitter, +Jitter).
+	Jitter time.Duration
+
+	// Reorder is the probability that a packet is held back to be replayed
+	// after the next packet on the same edge, rather than delivered in order.
+	Reorder float64
+
+	// Duplicate is the probability that a packet is enqueued a second time.
+	Duplicate float64
+
+	// Seed seeds the edge's RNG so runs are reproducible.
+	Seed int64
+}
+
+type pendingPacket struct {
+	readyAt time.Time
+	from    *nebula.Control
+	to      *nebula.Control
+	data    []byte
+}
+
+// impairment tracks the reordering/replay buffer for a single edge. It has
+// no clock of its own — every readyAt is computed against the R's shared
+// virtual clock, passed in by the caller, so an edge's schedule can never
+// drift out of sync with the rest of the router.
+type impairment struct {
+	profile Profile
+	rng     *rand.Rand
+	pending []pendingPacket
+	held    *pendingPacket
+}
+
+func newImpairment(p Profile) *impairment {
+	return &impairment{
+		profile: p,
+		rng:     rand.New(rand.NewSource(p.Seed)),
+	}
+}
+
+// enqueue applies loss/duplicate/delay/jitter and schedules the packet for
+// delivery once the router's virtual clock reaches its readyAt time.
+func (imp *impairment) enqueue(now time.Time, from, to *nebula.Control, data []byte) {
+	if imp.rng.Float64() < imp.profile.Loss {
+		return
+	}
+
+	delay := imp.profile.Delay
+	if imp.profile.Jitter > 0 {
+		jitter := time.Duration(imp.rng.Int63n(int64(imp.profile.Jitter)*2)) - imp.profile.Jitter
+		delay += jitter
+	}
+
+	pkt := pendingPacket{readyAt: now.Add(delay), from: from, to: to, data: data}
+
+	if imp.rng.Float64() < imp.profile.Reorder && imp.held == nil {
+		// Hold this packet back; it will be released after the next one on
+		// this edge is enqueued, producing out-of-order delivery.
+		imp.held = &pkt
+		return
+	}
+
+	imp.pending = append(imp.pending, pkt)
+	if imp.held != nil {
+		imp.pending = append(imp.pending, *imp.held)
+		imp.held = nil
+	}
+
+	if imp.rng.Float64() < imp.profile.Duplicate {
+		imp.pending = append(imp.pending, pkt)
+	}
+}
+
+// drainReady delivers every packet whose readyAt has passed on the router's
+// virtual clock.
+func (imp *impairment) drainReady(r *R) {
+	remaining := imp.pending[:0]
+	for _, pkt := range imp.pending {
+		if pkt.readyAt.After(r.now) {
+			remaining = append(remaining, pkt)
+			continue
+		}
+		r.pcap.write(pkt.from.GetUDPAddr().String(), pkt.to.GetUDPAddr().String(), r.now, "outside", pkt.data)
+		pkt.to.InjectUDPPacket(pkt.from.GetUDPAddr(), pkt.data)
+	}
+	imp.pending = remaining
+}
+
+var _ net.Addr = (*net.UDPAddr)(nil)
@@ -0,0 +1,52 @@
+package nebula
+
+import "time"
+
+// clock abstracts the handful of time.* calls that nebula's timer-driven
+// subsystems (handshake retries, pending_deletion, connection_alive) depend
+// on, so tests can advance virtual time instead of sleeping on the wall
+// clock. realClock is used everywhere in production; e2e tests substitute a
+// fakeClock (see clock_fake.go) driven by the e2e router.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) timer
+	Sleep(d time.Duration)
+}
+
+// timer mirrors the subset of *time.Timer that callers need: reading the
+// fire channel and resetting/stopping it. Kept as an interface so fakeClock
+// can hand out timers whose channel it controls directly.
+type timer interface {
+	C() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+// realClock is the production clock implementation, a thin pass-through to
+// the time package.
+type realClock struct{}
+
+// newClockFn is overridden in clock_fake.go under the e2e_testing build tag
+// so every subsystem that calls newClock() picks up a shared fake clock.
+var newClockFn = func() clock { return realClock{} }
+
+func newClock() clock {
+	return newClockFn()
+}
+
+func (realClock) Now() time.Time                      { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) Sleep(d time.Duration)               { time.Sleep(d) }
+
+func (realClock) NewTimer(d time.Duration) timer {
+	return &realTimer{t: time.NewTimer(d)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (r *realTimer) C() <-chan time.Time      { return r.t.C }
+func (r *realTimer) Reset(d time.Duration) bool { return r.t.Reset(d) }
+func (r *realTimer) Stop() bool                { return r.t.Stop() }
@@ -0,0 +1,130 @@
+//go:build e2e_testing
+// +build e2e_testing
+
+package nebula
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// fakeClock replaces realClock under e2e_testing so e2e/router.R can drive
+// nebula's timer-driven subsystems explicitly via Advance instead of the
+// test waiting on wall-clock sleeps. All waiters (After channels and timers)
+// are fired in now-order whenever Advance moves past their deadline.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+type fakeWaiter struct {
+	deadline time.Time
+	ch       chan time.Time
+	// fired is true once this waiter has delivered its one tick; repeating
+	// timers re-arm by replacing themselves in the waiters slice on Reset.
+	fired bool
+}
+
+// newFakeClock returns a clock pinned at the Unix epoch; e2e tests advance it
+// explicitly and never rely on wall-clock ordering.
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+// testClock is the single fake clock shared by every nebula.Control created
+// in an e2e_testing binary. newClock returns it instead of a realClock so
+// every Control's handshake/connection/lighthouse timers advance together
+// when the test calls AdvanceClock (wired up by e2e/router.R.Advance).
+var testClock = newFakeClock()
+
+func init() {
+	// Override the production clock constructor under e2e_testing so every
+	// subsystem that calls newClock() picks up the shared fake clock.
+	newClockFn = func() clock { return testClock }
+}
+
+// AdvanceClock moves every e2e Control's virtual clock forward by d. It's
+// exported for e2e/router.R, which calls it from R.Advance.
+func AdvanceClock(d time.Duration) {
+	testClock.Advance(d)
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Sleep(d time.Duration) {
+	<-f.After(d)
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w := &fakeWaiter{deadline: f.now.Add(d), ch: make(chan time.Time, 1)}
+	f.waiters = append(f.waiters, w)
+	return w.ch
+}
+
+func (f *fakeClock) NewTimer(d time.Duration) timer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t := &fakeTimer{clock: f, w: &fakeWaiter{deadline: f.now.Add(d), ch: make(chan time.Time, 1)}}
+	f.waiters = append(f.waiters, t.w)
+	return t
+}
+
+// Advance moves virtual time forward by d and fires every waiter whose
+// deadline has now passed, in deadline order.
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = f.now.Add(d)
+	sort.SliceStable(f.waiters, func(i, j int) bool {
+		return f.waiters[i].deadline.Before(f.waiters[j].deadline)
+	})
+	remaining := f.waiters[:0]
+	for _, w := range f.waiters {
+		if !w.fired && !w.deadline.After(f.now) {
+			w.fired = true
+			w.ch <- f.now
+			continue
+		}
+		remaining = append(remaining, w)
+	}
+	f.waiters = remaining
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	w     *fakeWaiter
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.w.ch }
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	wasPending := !t.w.fired
+	// Retire the old waiter so its deadline no longer fires.
+	t.w.fired = true
+	t.w = &fakeWaiter{deadline: t.clock.now.Add(d), ch: t.w.ch}
+	t.clock.waiters = append(t.clock.waiters, t.w)
+	return wasPending
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	wasPending := !t.w.fired
+	t.w.fired = true
+	return wasPending
+}
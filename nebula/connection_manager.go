@@ -0,0 +1,79 @@
+package nebula
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// connectionManager walks its last-seen table on two independent tickers:
+// one logs peers quiet for longer than connection_alive_interval, and one
+// forgets peers quiet for longer than pending_deletion_interval. Neither
+// sends a probe or removes the peer's entry from Control's hostmap.
+// Both tickers come from clk so e2e tests can drive them with the virtual
+// clock instead of sleeping in real time.
+type connectionManager struct {
+	l     *logrus.Logger
+	clock clock
+
+	aliveInterval    time.Duration
+	pendingDeletion  time.Duration
+
+	lastSeen map[iputil.VpnIp]time.Time
+}
+
+func newConnectionManager(l *logrus.Logger, cfg *config.C, clk clock) *connectionManager {
+	return &connectionManager{
+		l:               l,
+		clock:           clk,
+		aliveInterval:   time.Duration(cfg.GetInt("timers.connection_alive_interval", 5)) * time.Second,
+		pendingDeletion: time.Duration(cfg.GetInt("timers.pending_deletion_interval", 10)) * time.Second,
+		lastSeen:        make(map[iputil.VpnIp]time.Time),
+	}
+}
+
+// Start runs the alive and pending_deletion sweeps until stop is closed.
+func (cm *connectionManager) Start(stop <-chan struct{}) {
+	go cm.run(cm.aliveInterval, cm.sweepAlive, stop)
+	go cm.run(cm.pendingDeletion, cm.sweepPendingDeletion, stop)
+}
+
+func (cm *connectionManager) run(interval time.Duration, sweep func(), stop <-chan struct{}) {
+	t := cm.clock.NewTimer(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C():
+			sweep()
+			t.Reset(interval)
+		}
+	}
+}
+
+func (cm *connectionManager) Touch(vpnIp iputil.VpnIp) {
+	cm.lastSeen[vpnIp] = cm.clock.Now()
+}
+
+func (cm *connectionManager) sweepAlive() {
+	now := cm.clock.Now()
+	for vpnIp, seen := range cm.lastSeen {
+		if now.Sub(seen) > cm.aliveInterval {
+			cm.l.WithField("vpnIp", vpnIp).Debug("connection_alive_interval elapsed, probing")
+		}
+	}
+}
+
+func (cm *connectionManager) sweepPendingDeletion() {
+	now := cm.clock.Now()
+	for vpnIp, seen := range cm.lastSeen {
+		if now.Sub(seen) > cm.pendingDeletion {
+			cm.l.WithField("vpnIp", vpnIp).Debug("pending_deletion_interval elapsed, dropping tunnel")
+			delete(cm.lastSeen, vpnIp)
+		}
+	}
+}
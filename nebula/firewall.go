@@ -0,0 +1,179 @@
+package nebula
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/slackhq/nebula/config"
+)
+
+// firewallRule is one entry of a firewall.inbound/outbound list: an allow
+// rule matched against a remote peer's proto/port/groups.
+type firewallRule struct {
+	Proto string
+	Port  string
+	Host  string
+	Group string
+}
+
+// Firewall holds the allow-rules parsed from the firewall.inbound/outbound
+// config blocks. Every entry is an allow rule; a direction with no matching
+// rule denies the packet, matching nebula's default-deny model.
+type Firewall struct {
+	outbound []firewallRule
+	inbound  []firewallRule
+}
+
+func newFirewallFromConfig(cfg *config.C) *Firewall {
+	return &Firewall{
+		outbound: parseFirewallRules(cfg.Get("firewall.outbound")),
+		inbound:  parseFirewallRules(cfg.Get("firewall.inbound")),
+	}
+}
+
+func parseFirewallRules(raw interface{}) []firewallRule {
+	items, ok := raw.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	rules := make([]firewallRule, 0, len(items))
+	for _, item := range items {
+		rules = append(rules, firewallRule{
+			Proto: stringField(item, "proto", "any"),
+			Port:  stringField(item, "port", "any"),
+			Host:  stringField(item, "host", "any"),
+			Group: stringField(item, "group", ""),
+		})
+	}
+
+	return rules
+}
+
+func stringField(raw interface{}, key, def string) string {
+	fields, ok := asStringMap(raw)
+	if !ok {
+		return def
+	}
+	if v, ok := fields[key]; ok {
+		return toString(v)
+	}
+	return def
+}
+
+func toString(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case int:
+		return strconv.Itoa(t)
+	default:
+		return ""
+	}
+}
+
+// asStringMap normalizes the two shapes a yaml-decoded map can come back as
+// (map[string]interface{} or map[interface{}]interface{}, depending on the
+// decoder) into the former.
+func asStringMap(raw interface{}) (map[string]interface{}, bool) {
+	switch m := raw.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			if ks, ok := k.(string); ok {
+				out[ks] = v
+			}
+		}
+		return out, true
+	}
+	return nil, false
+}
+
+// Allow reports whether a packet in direction ("inbound" or "outbound"),
+// for proto/port, to/from a peer presenting remoteGroups, is allowed by any
+// configured rule.
+func (fw *Firewall) Allow(direction, proto string, port uint16, remoteGroups []string) bool {
+	rules := fw.outbound
+	if direction == "inbound" {
+		rules = fw.inbound
+	}
+
+	for _, r := range rules {
+		if r.Proto != "any" && r.Proto != proto {
+			continue
+		}
+		if r.Port != "any" && r.Port != strconv.Itoa(int(port)) {
+			continue
+		}
+		if r.Group != "" && !hasGroup(remoteGroups, r.Group) {
+			continue
+		}
+		return true
+	}
+
+	return false
+}
+
+func hasGroup(groups []string, group string) bool {
+	for _, g := range groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowList gates packets by the remote peer's vpn ip, independent of the
+// firewall rules above, matching the most specific (longest prefix)
+// configured CIDR.
+type AllowList struct {
+	entries []allowEntry
+}
+
+type allowEntry struct {
+	ipNet *net.IPNet
+	allow bool
+}
+
+func newAllowListFromConfig(cfg *config.C) *AllowList {
+	m, ok := asStringMap(cfg.Get("allow_list"))
+	if !ok {
+		return &AllowList{}
+	}
+
+	al := &AllowList{}
+	for cidr, v := range m {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		allow, _ := v.(bool)
+		al.entries = append(al.entries, allowEntry{ipNet: ipNet, allow: allow})
+	}
+
+	return al
+}
+
+// Allow reports whether ip is allowed through, using the most specific
+// matching entry. With no configured entries, everything is allowed.
+func (al *AllowList) Allow(ip net.IP) bool {
+	if al == nil || len(al.entries) == 0 {
+		return true
+	}
+
+	best := -1
+	result := true
+	for _, e := range al.entries {
+		if !e.ipNet.Contains(ip) {
+			continue
+		}
+		if ones, _ := e.ipNet.Mask.Size(); ones > best {
+			best = ones
+			result = e.allow
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,104 @@
+package nebula
+
+import (
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/sirupsen/logrus"
+)
+
+// HandshakeManager owns in-progress handshakes and retries them on a timer
+// until they complete; there is no retry limit. It reads ticks from a clock so
+// e2e tests can drive retries deterministically via the virtual clock
+// instead of waiting on wall-clock retry intervals.
+type HandshakeManager struct {
+	l           *logrus.Logger
+	clock       clock
+	tryInterval time.Duration
+	pending     map[iputil.VpnIp]*handshakeAttempt
+	trigger     chan iputil.VpnIp
+
+	// send transmits a handshake init for vpnIp. It's set once via
+	// SetSendFunc after Control is constructed, since Control itself needs
+	// a HandshakeManager to exist first.
+	send func(vpnIp iputil.VpnIp)
+}
+
+type handshakeAttempt struct {
+	vpnIp   iputil.VpnIp
+	timer   timer
+	retries int
+}
+
+// NewHandshakeManager builds a HandshakeManager using clk to schedule
+// retries. clk is newClock() in production and the shared fake clock under
+// e2e_testing, so Main doesn't need to know which one it's passing along.
+func NewHandshakeManager(l *logrus.Logger, cfg *config.C, clk clock) *HandshakeManager {
+	interval := cfg.GetDuration("handshakes.try_interval", time.Second)
+
+	return &HandshakeManager{
+		l:           l,
+		clock:       clk,
+		tryInterval: interval,
+		pending:     make(map[iputil.VpnIp]*handshakeAttempt),
+		trigger:     make(chan iputil.VpnIp, 16),
+	}
+}
+
+// SetSendFunc wires up the function HandshakeManager calls to actually
+// transmit a handshake init, both on the first attempt and every retry.
+// Control calls this once, right after construction.
+func (hm *HandshakeManager) SetSendFunc(send func(vpnIp iputil.VpnIp)) {
+	hm.send = send
+}
+
+// StartHandshake sends a handshake init for vpnIp immediately and begins
+// (or restarts) its retry timer. The timer fires on hm.clock, which under
+// e2e_testing is the shared fake clock that e2e/router.R.Advance drives.
+func (hm *HandshakeManager) StartHandshake(vpnIp iputil.VpnIp) {
+	a, ok := hm.pending[vpnIp]
+	if !ok {
+		a = &handshakeAttempt{vpnIp: vpnIp, timer: hm.clock.NewTimer(hm.tryInterval)}
+		hm.pending[vpnIp] = a
+		go hm.watchRetries(a)
+	} else {
+		a.retries++
+		a.timer.Reset(hm.tryInterval)
+	}
+
+	if hm.send != nil {
+		hm.send(vpnIp)
+	}
+}
+
+// watchRetries re-sends the handshake every time the attempt's timer fires,
+// until the entry is removed from hm.pending (handshake completed).
+func (hm *HandshakeManager) watchRetries(a *handshakeAttempt) {
+	for {
+		_, ok := <-a.timer.C()
+		if !ok {
+			return
+		}
+
+		if _, stillPending := hm.pending[a.vpnIp]; !stillPending {
+			return
+		}
+
+		hm.l.WithField("vpnIp", a.vpnIp).Debug("retrying handshake")
+		a.retries++
+		a.timer.Reset(hm.tryInterval)
+
+		if hm.send != nil {
+			hm.send(a.vpnIp)
+		}
+	}
+}
+
+// Complete removes vpnIp from the retry set once the handshake finishes.
+func (hm *HandshakeManager) Complete(vpnIp iputil.VpnIp) {
+	if a, ok := hm.pending[vpnIp]; ok {
+		a.timer.Stop()
+		delete(hm.pending, vpnIp)
+	}
+}
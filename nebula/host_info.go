@@ -0,0 +1,20 @@
+package nebula
+
+import "net"
+
+// HostInfo is what a Control knows about one remote peer: its vpn ip, the
+// outside address currently used to reach it, the index pair negotiated
+// during the handshake, and the peer's certificate groups (used for
+// group-based firewall rules).
+type HostInfo struct {
+	VpnIp         net.IP
+	CurrentRemote *net.UDPAddr
+	LocalIndex    uint32
+	RemoteIndex   uint32
+	Groups        []string
+
+	established bool
+	// dnsHostname is set for peers discovered through a static_host_map
+	// hostname entry, so Control knows which entries to re-resolve.
+	dnsHostname string
+}
@@ -0,0 +1,42 @@
+package nebula
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// LightHouse runs a re-announce loop on a clock-driven ticker, rather than
+// time.After, so e2e tests can advance it deterministically alongside
+// handshake and connection manager timers. Each tick only logs: no address
+// announcement or peer query is sent.
+type LightHouse struct {
+	l        *logrus.Logger
+	clock    clock
+	interval time.Duration
+}
+
+func NewLightHouse(l *logrus.Logger, cfg *config.C, clk clock) *LightHouse {
+	return &LightHouse{
+		l:        l,
+		clock:    clk,
+		interval: cfg.GetDuration("lighthouse.interval", time.Second),
+	}
+}
+
+// Start runs the re-announce loop on lh.clock until stop is closed.
+func (lh *LightHouse) Start(stop <-chan struct{}) {
+	t := lh.clock.NewTimer(lh.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C():
+			lh.l.Debug("re-announcing to lighthouses")
+			t.Reset(lh.interval)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package nebula
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// buildTimerSubsystems constructs the handshake manager, connection manager
+// and lighthouse with a single shared clock, which Main calls during
+// startup. Keeping the clock construction in one place means production
+// builds always get realClock and e2e_testing builds always get the shared
+// fake clock that e2e/router.R.Advance drives — no subsystem constructs its
+// own clock. The clock itself is also returned so Control can drive its own
+// clock-scheduled work (static_host_map DNS refresh) off the same source.
+func buildTimerSubsystems(l *logrus.Logger, cfg *config.C) (*HandshakeManager, *connectionManager, *LightHouse, clock) {
+	clk := newClock()
+
+	hm := NewHandshakeManager(l, cfg, clk)
+	cm := newConnectionManager(l, cfg, clk)
+	lh := NewLightHouse(l, cfg, clk)
+
+	return hm, cm, lh, clk
+}
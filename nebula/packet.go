@@ -0,0 +1,154 @@
+package nebula
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// UdpPacket is what Control.GetFromUDP hands the e2e router: a message this
+// instance wants sent to a peer's real outside UDP endpoint.
+type UdpPacket struct {
+	ToIp   net.IP
+	ToPort uint16
+	Data   []byte
+}
+
+// Wire message types. The first byte of every outside UDP message is one of
+// these; everything after it is type-specific.
+const (
+	msgHandshakeInit = iota
+	msgHandshakeResponse
+	msgData
+)
+
+// buildIPv4UDP serializes a minimal IPv4+UDP packet, the same shape
+// assertUdpPacket in the e2e suite parses back out with gopacket.
+func buildIPv4UDP(src, dst net.IP, srcPort, dstPort uint16, payload []byte) ([]byte, error) {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    src.To4(),
+		DstIP:    dst.To4(),
+	}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		return nil, err
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, udp, gopacket.Payload(payload)); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// buildIPv4TCP is buildIPv4UDP's TCP counterpart, for InjectTunTCPPacket.
+func buildIPv4TCP(src, dst net.IP, srcPort, dstPort uint16, payload []byte) ([]byte, error) {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    src.To4(),
+		DstIP:    dst.To4(),
+	}
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(srcPort), DstPort: layers.TCPPort(dstPort), ACK: true}
+	if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+		return nil, err
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, tcp, gopacket.Payload(payload)); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// parseIPv4Proto pulls the L4 proto name and destination port back out of a
+// raw packet built by buildIPv4UDP/buildIPv4TCP, for firewall matching.
+func parseIPv4Proto(data []byte) (proto string, port uint16, err error) {
+	packet := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Lazy)
+	v4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		return "", 0, fmt.Errorf("packet has no ipv4 layer")
+	}
+
+	switch v4.Protocol {
+	case layers.IPProtocolUDP:
+		if udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
+			return "udp", uint16(udp.DstPort), nil
+		}
+	case layers.IPProtocolTCP:
+		if tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+			return "tcp", uint16(tcp.DstPort), nil
+		}
+	}
+
+	return "", 0, fmt.Errorf("unsupported ip protocol %v", v4.Protocol)
+}
+
+// marshalHandshake encodes the tiny handshake payload exchanged to agree on
+// index numbers and hand over certificate groups for firewall matching.
+func marshalHandshake(vpnIp net.IP, localIndex uint32, groups []string) []byte {
+	var buf bytes.Buffer
+	buf.Write(vpnIp.To4())
+	_ = binary.Write(&buf, binary.BigEndian, localIndex)
+
+	g := []byte(joinGroups(groups))
+	_ = binary.Write(&buf, binary.BigEndian, uint16(len(g)))
+	buf.Write(g)
+
+	return buf.Bytes()
+}
+
+func unmarshalHandshake(data []byte) (vpnIp net.IP, index uint32, groups []string, err error) {
+	if len(data) < 10 {
+		return nil, 0, nil, fmt.Errorf("handshake message too short")
+	}
+
+	vpnIp = net.IP(append([]byte{}, data[0:4]...))
+	index = binary.BigEndian.Uint32(data[4:8])
+	glen := int(binary.BigEndian.Uint16(data[8:10]))
+	if len(data) < 10+glen {
+		return nil, 0, nil, fmt.Errorf("handshake message truncated")
+	}
+
+	groups = splitGroups(string(data[10 : 10+glen]))
+	return vpnIp, index, groups, nil
+}
+
+func joinGroups(groups []string) string {
+	out := ""
+	for i, g := range groups {
+		if i > 0 {
+			out += ","
+		}
+		out += g
+	}
+	return out
+}
+
+func splitGroups(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	var out []string
+	start := 0
+	for i := 0; i <= len(s); i++ {
+		if i == len(s) || s[i] == ',' {
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+	return out
+}
@@ -0,0 +1,49 @@
+package nebula
+
+import (
+	"context"
+	"net"
+	"net/netip"
+)
+
+// Resolver abstracts the DNS lookups nebula performs when resolving
+// static_host_map entries that name a hostname instead of a literal IP. The
+// default implementation defers to net.DefaultResolver; e2e tests substitute
+// a scripted resolver so DNS TTL expiry and mixed v4/v6 answers can be
+// exercised deterministically (see remote_list.unlockedCollect).
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// defaultResolver wraps the stdlib resolver nebula uses outside of tests.
+type defaultResolver struct{}
+
+func (defaultResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	return net.DefaultResolver.LookupNetIP(ctx, network, host)
+}
+
+// options collects the knobs that can be set via the variadic Option
+// parameters accepted by Main.
+type options struct {
+	resolver Resolver
+}
+
+// Option customizes a nebula instance at construction time, beyond what's
+// expressible in the yaml config.
+type Option func(*options)
+
+// WithResolver overrides the resolver used for static_host_map hostname
+// entries. Defaults to defaultResolver when not set.
+func WithResolver(r Resolver) Option {
+	return func(o *options) {
+		o.resolver = r
+	}
+}
+
+func newOptions(opts ...Option) *options {
+	o := &options{resolver: defaultResolver{}}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}